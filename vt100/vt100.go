@@ -3,8 +3,10 @@ package vt100
 import (
 	"bytes"
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
-	"unicode"
+	"unicode/utf8"
 )
 
 // TokVal contains a unique integer value for all vt100 escape
@@ -37,6 +39,7 @@ const (
 	GetCursor
 	HvHome
 	HvPos
+	Hyperlink
 	Ident
 	Index
 	Invisible
@@ -79,6 +82,7 @@ const (
 	SetSpecG1
 	SetSS2
 	SetSS3
+	SetTitle
 	SetUKG0
 	SetUKG1
 	SetUSG0
@@ -86,6 +90,7 @@ const (
 	SetVT52
 	SetWin
 	SetWrap
+	SGR
 	Swsh
 	TabClr
 	TabClrAll
@@ -97,19 +102,26 @@ const (
 	Underline
 )
 
+// Unknown is the TokVal carried by a Token whose CSI, ESC, OSC, or DCS
+// dispatch doesn't correspond to one of the named constants above. The
+// dispatch is not lost: Kind, Intermediates, Final, RawParams, Text,
+// and Bytes() still describe exactly what was received, so a caller
+// can decode it itself or pass it through unmodified.
+const Unknown TokVal = 256
+
 // Note that this list has to directly correspond to the above
 // list of constants in both order and number.
 // (literal pool)
 var data = bytes.NewBufferString(`Align AltKeypad Blink Bold ClearBOL
 ClearBOS ClearEOL ClearEOS ClearLine ClearScreen CursorDn CursorHome
 CursorLf CursorPos CursorRt CursorUp DevStat DhBot DhTop Dwsh GetCursor
-HvHome HvPos Ident Index Invisible Led1 Led2 Led3 Led4 LedsOff LowInt
-ModesOff NextLine NumKeypad Reset ResetCol ResetInter ResetRep ResetWrap
-RestoreCursor Reverse RevIndex SaveCursor SetAltG0 SetAltG1 SetAltSpecG0
-SetAltSpecG1 SetAppl SetCol SetCursor SetInter SetJump SetLF SetNL
-SetNormScrn SetOrgAbs SetOrgRel SetRep SetRevScrn SetSmooth SetSpecG0
-SetSpecG1 SetSS2 SetSS3 SetUKG0 SetUKG1 SetUSG0 SetUSG1 SetVT52 SetWin
-SetWrap Swsh TabClr TabClrAll TabSet TestLB TestLBRep TestPU TestPURep
+HvHome HvPos Hyperlink Ident Index Invisible Led1 Led2 Led3 Led4 LedsOff
+LowInt ModesOff NextLine NumKeypad Reset ResetCol ResetInter ResetRep
+ResetWrap RestoreCursor Reverse RevIndex SaveCursor SetAltG0 SetAltG1
+SetAltSpecG0 SetAltSpecG1 SetAppl SetCol SetCursor SetInter SetJump SetLF
+SetNL SetNormScrn SetOrgAbs SetOrgRel SetRep SetRevScrn SetSmooth SetSpecG0
+SetSpecG1 SetSS2 SetSS3 SetTitle SetUKG0 SetUKG1 SetUSG0 SetUSG1 SetVT52
+SetWin SetWrap SGR Swsh TabClr TabClrAll TabSet TestLB TestLBRep TestPU TestPURep
 Underline`)
 
 var labelMap = make(map[TokVal]string)
@@ -129,7 +141,7 @@ func init() {
 		}
 	}
 
-	if len(labelMap) != 81 {
+	if len(labelMap) != 84 {
 		panic("Symbol count changed; verify const pool w/literal pool")
 	}
 }
@@ -142,35 +154,132 @@ func (t TokVal) String() string {
 	return l
 }
 
+// Kind identifies the shape of escape-sequence dispatch that produced
+// a Token.
+type Kind int
+
+const (
+	KindChar Kind = iota // a C0 control byte (or a ground-state DEL) executed outside a string; Value is TokVal(byte)
+	KindText             // one ground-state printable rune, UTF-8 decoded; see Text
+	KindESC              // ESC [intermediates] final
+	KindCSI              // CSI [params] [intermediates] final
+	KindOSC              // OSC payload ST (or BEL)
+	KindDCS              // DCS [params] [intermediates] final passthrough-data ST
+)
+
+// MissingParam is the value of a CSI/DCS parameter (or sub-parameter)
+// that was left empty, e.g. the first parameter in "\033[;5H" or the middle field
+// of "\033[38:2::255:0:0m".
+const MissingParam = -1
+
+// Param is one semicolon-delimited CSI/DCS parameter together with any
+// colon-delimited sub-parameters (ISO 8613-6 style), e.g. parsing
+// "38:2::255:0:0" yields Param{38, 2, MissingParam, 255, 0, 0}.
+type Param []int
+
 // Token encapsulates all salient aspects regarding a received
 // VT-100 escape sequence
 type Token struct {
-	Value  TokVal // unique integer value
-	Params []int  // Parameters, if any (i.e. cursor positioning, etc.)
-	seq    []byte // captured escape sequence
+	Kind          Kind            // what shape of dispatch produced this token
+	Value         TokVal          // decoded value; Unknown if Kind isn't a recognized legacy sequence
+	Params        []int           // decoded parameters, if any (i.e. cursor positioning, etc.)
+	RawParams     []Param         // full semicolon/colon parameter list, for CSI and DCS
+	Intermediates []byte          // collected intermediate/private-marker bytes
+	Final         byte            // final dispatch byte; 0 for OSC
+	Text          string          // decoded rune for KindText; accumulated string body for OSC/DCS passthrough otherwise
+	SGR           *SGRState       // decoded attributes/colors, when Value == SGR
+	Title         *TitleState     // decoded icon/window title, when Value == SetTitle
+	Link          *HyperlinkState // decoded hyperlink, when Value == Hyperlink
+	seq           []byte          // captured escape sequence
 }
 
 func (t Token) String() string {
 	return fmt.Sprintf("%s Params: %v, Byte Seq: %v", t.Value, t.Params, t.seq)
 }
 
+// Bytes returns the raw bytes captured for this token, escape
+// introducer included. Callers that don't recognize (or don't care
+// about) a particular TokVal can use this to pass the sequence
+// through unmodified instead of re-synthesizing it.
+func (t Token) Bytes() []byte {
+	return t.seq
+}
+
 // Lexer holds the state information for our VT-100 lexer
 type Lexer struct {
-	input           chan byte
-	Output          chan *Token
-	paramCharsAccum []byte
-	params          []int
-	seq             []byte
-	rundown         chan struct{}
-	wg              sync.WaitGroup
+	pstate        pstate
+	pendingEscape pstate // string state an ESC interrupted, while pstate == stStringEscape
+
+	intermediates []byte
+	csiParams     []Param
+	curGroup      Param
+	curParam      int
+	curHasDigit   bool
+	paramsTouched bool
+
+	strBuf []byte // OSC payload / DCS passthrough data, accumulated
+	final  byte   // DCS final byte, remembered through DCS_PASSTHROUGH
+
+	utf8Buf []byte // ground-state bytes collected toward the in-progress UTF-8 rune
+
+	seq     []byte
+	onToken func(*Token)
+
+	// The following fields back the legacy channel-based API and are
+	// only populated by NewLexer.
+	input   chan byte
+	Output  chan *Token
+	rundown chan struct{}
+	wg      sync.WaitGroup
 }
 
-// NewLexer creates a new VT-100 lexer state machine
-func NewLexer() *Lexer {
+// NewWriter creates a VT-100 lexer that drives the state machine
+// synchronously off of bytes passed to Write, invoking onToken for
+// each token as it is recognized. Unlike NewLexer, no goroutine or
+// channel is involved: Write runs entirely in the caller's goroutine,
+// which makes it suitable for wrapping with a bufio.Writer or handing
+// to io.Copy when reading from os.Stdin, a PTY, or a net.Conn.
+func NewWriter(onToken func(*Token)) *Lexer {
 	l := new(Lexer)
+	l.pstate = stGround
+	l.onToken = onToken
+	return l
+}
+
+// Write feeds p through the lexer's state machine, invoking the
+// onToken callback supplied to NewWriter for every token recognized
+// along the way. It always consumes all of p and never returns an
+// error; it exists so that a *Lexer satisfies io.Writer.
+func (l *Lexer) Write(p []byte) (int, error) {
+	for _, c := range p {
+		l.feed(c)
+	}
+	return len(p), nil
+}
+
+// feed advances the state machine by a single byte.
+func (l *Lexer) feed(c byte) {
+	// Capped the same way strBuf is (see maxStringLen): an unterminated
+	// OSC/DCS/SOS-PM-APC string would otherwise grow l.seq right along
+	// with it, even once strBuf itself stopped growing.
+	if l.seq != nil && len(l.seq) < maxStringLen {
+		l.seq = append(l.seq, c)
+	}
+	l.step(c)
+}
+
+// NewLexer creates a new VT-100 lexer state machine with the legacy
+// channel-based API. Internally it is a thin wrapper around NewWriter:
+// a goroutine drains l.input and feeds the state machine, emitting
+// tokens onto l.Output. Prefer NewWriter for new code; it avoids the
+// per-byte channel handoff and goroutine that make this API unsuitable
+// for high-volume terminal traffic.
+func NewLexer() *Lexer {
+	l := NewWriter(nil)
 	l.input = make(chan byte, 10)
 	l.Output = make(chan *Token, 10)
 	l.rundown = make(chan struct{})
+	l.onToken = func(t *Token) { l.Output <- t }
 	l.wg.Add(1)
 	go l.run()
 	return l
@@ -198,23 +307,16 @@ func (l *Lexer) Rundown() {
 	close(l.rundown)
 }
 
-// stateFn represents the state of the lexical scanner
-// as a function that returns the next state.
-type stateFn func(c byte) stateFn
-
-// run lexes the input by executing state functions until
-// the state is nil.
+// run drains l.input, feeding each byte through the state machine,
+// until told to stop via l.rundown. It is the goroutine body backing
+// the legacy channel-based API created by NewLexer.
 func (l *Lexer) run() {
 	defer l.wg.Done()
 
-	for state := l.ground; state != nil; {
+	for {
 		select {
 		case c := <-l.input:
-			c &= 0x7f
-			if l.seq != nil {
-				l.seq = append(l.seq, c)
-			}
-			state = state(c)
+			l.feed(c)
 
 		case <-l.rundown:
 			return
@@ -222,358 +324,1179 @@ func (l *Lexer) run() {
 	}
 }
 
-func (l *Lexer) send(tv TokVal) {
-	l.Output <- &Token{tv, l.params, l.seq}
+// emit delivers a token to the callback supplied to NewWriter/NewLexer.
+func (l *Lexer) emit(t *Token) {
+	if l.onToken != nil {
+		l.onToken(t)
+	}
+}
+
+// sendDecoded emits a plain KindChar token carrying tv: a control byte
+// received in ground state or executed in the middle of an escape sequence.
+func (l *Lexer) sendDecoded(tv TokVal) {
+	l.emit(&Token{Value: tv, seq: l.seq})
 }
 
-// Ground state of the Lexer
-func (l *Lexer) ground(c byte) stateFn {
-	l.paramCharsAccum, l.params, l.seq = nil, nil, nil
-	if c == 0x1b {
+// execute fires the "execute" action for C0 controls that arrive
+// outside of a string: they're decoded exactly like a ground character,
+// without otherwise disturbing the state machine.
+func (l *Lexer) execute(c byte) {
+	l.sendDecoded(TokVal(c))
+}
+
+// pstate is one of the states of the DEC ANSI / VT500-series parser
+// (as documented by Paul Williams' well-known state diagram), with one
+// addition: stStringEscape, a transient state used to look one byte
+// ahead after an ESC interrupts an OSC/DCS/SOS/PM/APC string, to decide
+// whether it's the first half of a string terminator (ESC \\) or the
+// start of a brand new escape sequence.
+type pstate int
+
+const (
+	stGround pstate = iota
+	stEscape
+	stEscapeIntermediate
+	stCSIEntry
+	stCSIParam
+	stCSIIntermediate
+	stCSIIgnore
+	stDCSEntry
+	stDCSParam
+	stDCSIntermediate
+	stDCSPassthrough
+	stDCSIgnore
+	stOSCString
+	stSOSPMAPCString
+	stStringEscape
+)
+
+// Byte classes, per the DEC ANSI parser's transition table.
+func isExecute(c byte) bool  { return c <= 0x17 || c == 0x19 || (c >= 0x1C && c <= 0x1F) }
+func isCollect(c byte) bool  { return c >= 0x20 && c <= 0x2F }
+func isMarker(c byte) bool   { return c >= 0x3C && c <= 0x3F }
+func isCSIFinal(c byte) bool { return c >= 0x40 && c <= 0x7E }
+func isDigit(c byte) bool    { return c >= '0' && c <= '9' }
+func isParamSep(c byte) bool { return c == ';' || c == ':' }
+
+// step advances the parser by one byte, applying the transitions that
+// are available from (almost) any state -- ESC, CAN/SUB, and the C1
+// shortcuts for CSI/OSC/DCS/ST -- before falling back to per-state
+// handling.
+func (l *Lexer) step(c byte) {
+	if l.pstate == stStringEscape {
+		l.stepStringEscape(c)
+		return
+	}
+
+	// A byte in 0x80-0xBF that follows an incomplete UTF-8 lead byte is a
+	// continuation byte of that rune, not a C1 control.
+	if len(l.utf8Buf) > 0 && c >= 0x80 && c <= 0xBF {
+		l.stepGround(c)
+		return
+	}
+
+	switch {
+	case c == 0x1B:
+		if l.inString() {
+			l.pendingEscape = l.pstate
+			l.pstate = stStringEscape
+			return
+		}
+		l.flushUTF8Buf()
+		l.seq = []byte{c}
+		l.enterEscape()
+		return
+
+	case c == 0x18 || c == 0x1A: // CAN, SUB: abort to ground
+		l.abortString()
+		l.flushUTF8Buf()
+		l.pstate = stGround
+		l.seq = nil
+		l.utf8Buf = nil
+		return
+
+	case c == 0x9B && !l.inString(): // C1 CSI
+		l.seq = []byte{c}
+		l.enterCSI()
+		return
+
+	case c == 0x9D && !l.inString(): // C1 OSC
+		l.seq = []byte{c}
+		l.enterOSC()
+		return
+
+	case c == 0x90 && !l.inString(): // C1 DCS
 		l.seq = []byte{c}
-		return l.intermediateChar
+		l.enterDCS()
+		return
+
+	case c == 0x9C && l.inString(): // C1 ST
+		l.terminateString(l.pstate)
+		l.pstate = stGround
+		l.seq = nil
+		return
+	}
+
+	switch l.pstate {
+	case stGround:
+		l.stepGround(c)
+	case stEscape:
+		l.stepEscape(c)
+	case stEscapeIntermediate:
+		l.stepEscapeIntermediate(c)
+	case stCSIEntry:
+		l.stepCSIEntry(c)
+	case stCSIParam:
+		l.stepCSIParam(c)
+	case stCSIIntermediate:
+		l.stepCSIIntermediate(c)
+	case stCSIIgnore:
+		l.stepCSIIgnore(c)
+	case stDCSEntry:
+		l.stepDCSEntry(c)
+	case stDCSParam:
+		l.stepDCSParam(c)
+	case stDCSIntermediate:
+		l.stepDCSIntermediate(c)
+	case stDCSPassthrough:
+		l.stepDCSPassthrough(c)
+	case stDCSIgnore:
+		l.stepDCSIgnore(c)
+	case stOSCString:
+		l.stepOSCString(c)
+	case stSOSPMAPCString:
+		l.stepSOSPMAPCString(c)
+	}
+}
+
+// stepStringEscape decides, one byte after an ESC interrupted an
+// OSC/DCS/SOS/PM/APC string, whether that ESC (together with this
+// byte) was a string terminator or the start of a new sequence.
+func (l *Lexer) stepStringEscape(c byte) {
+	pending := l.pendingEscape
+	if c == '\\' {
+		l.terminateString(pending)
+		l.pstate = stGround
+		l.seq = nil
+		return
+	}
+	// Not a valid ST: the lone ESC aborts the string, and this byte is
+	// processed as if it were the first byte following a fresh ESC. The
+	// aborted string's raw bytes must not leak into the new token, so
+	// seq restarts at the ESC that triggered this state (0x1B) followed
+	// by the byte being processed right now.
+	switch pending {
+	case stOSCString, stDCSPassthrough, stDCSIgnore:
+		l.strBuf = nil
+	}
+	l.seq = []byte{0x1B, c}
+	l.enterEscape()
+	l.stepEscape(c)
+}
+
+func (l *Lexer) inString() bool {
+	switch l.pstate {
+	case stOSCString, stDCSPassthrough, stDCSIgnore, stSOSPMAPCString:
+		return true
 	}
-	l.send(TokVal(c))
-	return l.ground
+	return false
+}
+
+func (l *Lexer) abortString() {
+	if l.inString() {
+		l.strBuf = nil
+	}
+}
+
+// terminateString runs the unhook/osc_end action appropriate for the
+// string state being ended by a terminator (ST or BEL).
+func (l *Lexer) terminateString(state pstate) {
+	switch state {
+	case stOSCString:
+		l.oscEnd()
+	case stDCSPassthrough, stDCSIgnore:
+		l.unhook()
+	}
+}
+
+func (l *Lexer) enterEscape() {
+	l.clearParams()
+	l.intermediates = nil
+	l.utf8Buf = nil
+	l.pstate = stEscape
+}
+
+func (l *Lexer) enterCSI() {
+	l.clearParams()
+	l.intermediates = nil
+	l.utf8Buf = nil
+	l.pstate = stCSIEntry
+}
+
+func (l *Lexer) enterDCS() {
+	l.clearParams()
+	l.intermediates = nil
+	l.strBuf = nil
+	l.utf8Buf = nil
+	l.pstate = stDCSEntry
+}
+
+func (l *Lexer) enterOSC() {
+	l.oscStart()
+	l.utf8Buf = nil
+	l.pstate = stOSCString
+}
+
+func (l *Lexer) enterSOSPMAPC() {
+	l.pstate = stSOSPMAPCString
 }
 
-func (l *Lexer) intermediateChar(c byte) stateFn {
+// clear resets the collected parameters ahead of a new CSI/DCS sequence.
+func (l *Lexer) clearParams() {
+	l.csiParams = nil
+	l.curGroup = nil
+	l.curParam = 0
+	l.curHasDigit = false
+	l.paramsTouched = false
+}
+
+// collect appends an intermediate or private-marker byte.
+func (l *Lexer) collect(c byte) {
+	l.intermediates = append(l.intermediates, c)
+}
+
+// param folds one parameter byte (digit, ';', or ':') into the
+// in-progress parameter list.
+func (l *Lexer) param(c byte) {
+	l.paramsTouched = true
 	switch c {
-	case '[':
-		return l.afterLeftSquareBracket
+	case ';':
+		l.curGroup = append(l.curGroup, l.takeParam())
+		l.csiParams = append(l.csiParams, l.curGroup)
+		l.curGroup = nil
+	case ':':
+		l.curGroup = append(l.curGroup, l.takeParam())
+	default:
+		if !l.curHasDigit {
+			l.curParam = 0
+		}
+		l.curParam = l.curParam*10 + int(c-'0')
+		l.curHasDigit = true
+	}
+}
+
+func (l *Lexer) takeParam() int {
+	v := MissingParam
+	if l.curHasDigit {
+		v = l.curParam
+	}
+	l.curParam, l.curHasDigit = 0, false
+	return v
+}
+
+// finishParams closes out the final (sub)parameter of a sequence that
+// never reached its own separator, e.g. the "3" in "\033[3A".
+func (l *Lexer) finishParams() []Param {
+	if !l.paramsTouched {
+		return nil
+	}
+	l.curGroup = append(l.curGroup, l.takeParam())
+	l.csiParams = append(l.csiParams, l.curGroup)
+	return l.csiParams
+}
+
+func (l *Lexer) hook(final byte) {
+	l.final = final
+	l.pstate = stDCSPassthrough
+}
+
+// maxStringLen caps how large an OSC payload or DCS passthrough body
+// is allowed to grow while waiting for its terminator (ST or BEL).
+// This parser is meant to sit directly on untrusted input -- a PTY or
+// net.Conn, per chunk0-1 -- and a peer that never sends a terminator
+// would otherwise make l.strBuf an unbounded memory sink. Bytes beyond
+// the cap are dropped; the string is still delivered (truncated) once
+// it does terminate, rather than the whole token being lost.
+const maxStringLen = 1 << 16 // 64 KiB; far beyond any real title, hyperlink URI, or DCS reply
+
+func (l *Lexer) put(c byte) {
+	if len(l.strBuf) >= maxStringLen {
+		return
+	}
+	l.strBuf = append(l.strBuf, c)
+}
+
+func (l *Lexer) unhook() {
+	tok := &Token{
+		Kind:          KindDCS,
+		Value:         Unknown,
+		RawParams:     l.finishParams(),
+		Intermediates: l.intermediates,
+		Final:         l.final,
+		Text:          string(l.strBuf),
+		seq:           l.seq,
+	}
+	l.strBuf = nil
+	l.emit(tok)
+}
+
+func (l *Lexer) oscStart() {
+	l.strBuf = nil
+}
+
+func (l *Lexer) oscPut(c byte) {
+	if len(l.strBuf) >= maxStringLen {
+		return
+	}
+	l.strBuf = append(l.strBuf, c)
+}
+
+func (l *Lexer) oscEnd() {
+	payload := string(l.strBuf)
+	tok := &Token{
+		Kind:  KindOSC,
+		Value: Unknown,
+		Text:  payload,
+		seq:   l.seq,
+	}
+	decodeOSC(payload, tok)
+	l.strBuf = nil
+	l.emit(tok)
+}
+
+func (l *Lexer) escDispatch(final byte) {
+	tok := &Token{
+		Kind:          KindESC,
+		Value:         decodeESC(l.intermediates, final),
+		Intermediates: l.intermediates,
+		Final:         final,
+		seq:           l.seq,
+	}
+	l.emit(tok)
+	l.pstate = stGround
+}
+
+func (l *Lexer) csiDispatch(final byte) {
+	params := l.finishParams()
+	value, legacy := decodeCSI(l.intermediates, params, final)
+	tok := &Token{
+		Kind:          KindCSI,
+		Value:         value,
+		Params:        legacy,
+		RawParams:     params,
+		Intermediates: l.intermediates,
+		Final:         final,
+		seq:           l.seq,
+	}
+	if value == SGR {
+		sgr := decodeSGR(params)
+		tok.SGR = &sgr
+	}
+	l.emit(tok)
+	l.pstate = stGround
+}
+
+// GROUND
+
+func (l *Lexer) stepGround(c byte) {
+	if c < 0x20 || c == 0x7F {
+		l.flushUTF8Buf()
+		l.seq = nil
+		l.sendDecoded(TokVal(c))
+		return
+	}
+
+	// Printable input, native UTF-8: accumulate bytes until they form a
+	// complete (or conclusively invalid) rune before emitting anything.
+	l.utf8Buf = append(l.utf8Buf, c)
+	l.decodeUTF8Buf()
+}
+
+// decodeUTF8Buf emits every complete (or conclusively invalid) rune
+// already sitting in l.utf8Buf, one token per rune, leaving only a
+// genuinely incomplete multi-byte prefix buffered for the next byte.
+// A single malformed byte only ever consumes itself (utf8.FullRune
+// reports an invalid lead/continuation byte as "full" immediately),
+// so this must loop rather than decode once and wait for more input.
+func (l *Lexer) decodeUTF8Buf() {
+	for len(l.utf8Buf) > 0 && utf8.FullRune(l.utf8Buf) {
+		r, size := utf8.DecodeRune(l.utf8Buf)
+		l.utf8Buf = l.utf8Buf[size:]
+		l.seq = nil
+		l.emit(&Token{Kind: KindText, Value: TokVal(r), Text: string(r)})
+	}
+}
+
+// flushUTF8Buf emits whatever bytes are left in l.utf8Buf -- a
+// truncated multi-byte lead byte that no continuation ever
+// completed -- as replacement-character runes instead of silently
+// dropping them, e.g. when a C0 control byte interrupts one.
+func (l *Lexer) flushUTF8Buf() {
+	for len(l.utf8Buf) > 0 {
+		r, size := utf8.DecodeRune(l.utf8Buf)
+		l.utf8Buf = l.utf8Buf[size:]
+		l.seq = nil
+		l.emit(&Token{Kind: KindText, Value: TokVal(r), Text: string(r)})
+	}
+}
+
+// ESCAPE
+
+func (l *Lexer) stepEscape(c byte) {
+	if isExecute(c) {
+		l.execute(c)
+		return
+	}
+	switch {
+	case c == '[':
+		l.enterCSI()
+	case c == ']':
+		l.enterOSC()
+	case c == 'P':
+		l.enterDCS()
+	case c == 'X' || c == '^' || c == '_':
+		l.enterSOSPMAPC()
+	case isCollect(c):
+		l.collect(c)
+		l.pstate = stEscapeIntermediate
+	case c == '7' || c == '8':
+		l.escDispatch(c)
+	case isDigit(c):
+		// Non-standard: this lexer models DEC device-status/cursor
+		// report requests as a bare digit followed by a terminating
+		// letter (ESC 5 n, ESC 6 n), so a stray digit here is treated
+		// like a collected intermediate awaiting its final byte.
+		l.collect(c)
+		l.pstate = stEscapeIntermediate
+	case c >= 0x30 && c <= 0x7E:
+		l.escDispatch(c)
+	default:
+		l.pstate = stGround
+	}
+}
+
+func (l *Lexer) stepEscapeIntermediate(c byte) {
+	if isExecute(c) {
+		l.execute(c)
+		return
+	}
+	switch {
+	case isCollect(c):
+		l.collect(c)
+	case c >= 0x30 && c <= 0x7E:
+		l.escDispatch(c)
+	default:
+		l.pstate = stGround
+	}
+}
+
+// CSI
+
+func (l *Lexer) stepCSIEntry(c byte) {
+	if isExecute(c) {
+		l.execute(c)
+		return
+	}
+	switch {
+	case isCollect(c):
+		l.collect(c)
+		l.pstate = stCSIIntermediate
+	case isMarker(c):
+		l.collect(c)
+		l.pstate = stCSIParam
+	case isDigit(c) || isParamSep(c):
+		l.param(c)
+		l.pstate = stCSIParam
+	case isCSIFinal(c):
+		l.csiDispatch(c)
+	default:
+		l.pstate = stCSIIgnore
+	}
+}
+
+func (l *Lexer) stepCSIParam(c byte) {
+	if isExecute(c) {
+		l.execute(c)
+		return
+	}
+	switch {
+	case isCollect(c):
+		l.collect(c)
+		l.pstate = stCSIIntermediate
+	case isDigit(c) || isParamSep(c):
+		l.param(c)
+	case isCSIFinal(c):
+		l.csiDispatch(c)
+	default:
+		l.pstate = stCSIIgnore
+	}
+}
+
+func (l *Lexer) stepCSIIntermediate(c byte) {
+	if isExecute(c) {
+		l.execute(c)
+		return
+	}
+	switch {
+	case isCollect(c):
+		l.collect(c)
+	case isCSIFinal(c):
+		l.csiDispatch(c)
+	default:
+		l.pstate = stCSIIgnore
+	}
+}
+
+func (l *Lexer) stepCSIIgnore(c byte) {
+	if isCSIFinal(c) {
+		l.pstate = stGround
+	}
+}
+
+// DCS
+
+func (l *Lexer) stepDCSEntry(c byte) {
+	switch {
+	case isExecute(c):
+	case isCollect(c):
+		l.collect(c)
+		l.pstate = stDCSIntermediate
+	case isMarker(c):
+		l.collect(c)
+		l.pstate = stDCSParam
+	case isDigit(c) || isParamSep(c):
+		l.param(c)
+		l.pstate = stDCSParam
+	case isCSIFinal(c):
+		l.hook(c)
+	default:
+		l.pstate = stDCSIgnore
+	}
+}
+
+func (l *Lexer) stepDCSParam(c byte) {
+	switch {
+	case isExecute(c):
+	case isCollect(c):
+		l.collect(c)
+		l.pstate = stDCSIntermediate
+	case isDigit(c) || isParamSep(c):
+		l.param(c)
+	case isCSIFinal(c):
+		l.hook(c)
+	default:
+		l.pstate = stDCSIgnore
+	}
+}
+
+func (l *Lexer) stepDCSIntermediate(c byte) {
+	switch {
+	case isExecute(c):
+	case isCollect(c):
+		l.collect(c)
+	case isCSIFinal(c):
+		l.hook(c)
+	default:
+		l.pstate = stDCSIgnore
+	}
+}
+
+func (l *Lexer) stepDCSPassthrough(c byte) {
+	l.put(c)
+}
+
+func (l *Lexer) stepDCSIgnore(byte) {
+	// Swallow everything; the string terminator is handled globally.
+}
+
+// OSC
+
+func (l *Lexer) stepOSCString(c byte) {
+	switch {
+	case c == 0x07: // BEL also terminates an OSC string
+		l.oscEnd()
+		l.pstate = stGround
+		l.seq = nil
+	case c >= 0x20:
+		l.oscPut(c)
+	}
+}
+
+// SOS / PM / APC
+
+func (l *Lexer) stepSOSPMAPCString(byte) {
+	// These strings carry no tokens this lexer decodes; only their
+	// terminator (handled globally) matters.
+}
+
+// decodeESC translates an ESC dispatch's collected intermediate(s) and
+// final byte into one of the named TokVal constants, where one exists.
+func decodeESC(intermediates []byte, final byte) TokVal {
+	if len(intermediates) == 0 {
+		switch final {
+		case 'D':
+			return Index
+		case 'M':
+			return RevIndex
+		case 'N':
+			return SetSS2
+		case 'O':
+			return SetSS3
+		case 'E':
+			return NextLine
+		case '7':
+			return SaveCursor
+		case '8':
+			return RestoreCursor
+		case '=':
+			return AltKeypad
+		case '>':
+			return NumKeypad
+		case 'H':
+			return TabSet
+		case 'c':
+			return Reset
+		}
+		return Unknown
+	}
+
+	switch intermediates[0] {
 	case '(':
-		return l.afterLeftParen
+		switch final {
+		case 'A':
+			return SetUKG0
+		case 'B':
+			return SetUSG0
+		case '0':
+			return SetSpecG0
+		case '1':
+			return SetAltG0
+		case '2':
+			return SetAltSpecG0
+		}
 	case ')':
-		return l.afterRightParen
+		switch final {
+		case 'A':
+			return SetUKG1
+		case 'B':
+			return SetUSG1
+		case '0':
+			return SetSpecG1
+		case '1':
+			return SetAltG1
+		case '2':
+			return SetAltSpecG1
+		}
 	case '#':
-		return l.escPound
-	case 'D':
-		l.send(Index)
-	case 'M':
-		l.send(RevIndex)
-	case 'N':
-		l.send(SetSS2)
-	case 'O':
-		l.send(SetSS3)
-	case 'E':
-		l.send(NextLine)
-	case '7':
-		l.send(SaveCursor)
-	case '8':
-		l.send(RestoreCursor)
-	case '=':
-		l.send(AltKeypad)
-	case '>':
-		l.send(NumKeypad)
-	case 'H':
-		l.send(TabSet)
-	case 'c':
-		l.send(Reset)
-
-	default:
-		if unicode.IsDigit(rune(c)) {
-			return l.escapeDigit // no left-square-bracket
+		switch final {
+		case '3':
+			return DhTop
+		case '4':
+			return DhBot
+		case '5':
+			return Swsh
+		case '6':
+			return Dwsh
+		case '8':
+			return Align
+		}
+	case '5':
+		if final == 'n' {
+			return DevStat
+		}
+	case '6':
+		if final == 'n' {
+			return GetCursor
 		}
 	}
-	return l.ground
+	return Unknown
 }
 
-func (l *Lexer) afterLeftSquareBracket(c byte) stateFn {
-	switch {
-	case unicode.IsLetter(rune(c)): // terminating char
-		return l.interpTerm(c)
+// marker returns the CSI private-marker byte (e.g. '?') collected
+// ahead of the parameters, or 0 if none was present.
+func marker(intermediates []byte) byte {
+	if len(intermediates) == 0 || !isMarker(intermediates[0]) {
+		return 0
+	}
+	return intermediates[0]
+}
 
-	case unicode.IsPrint(rune(c)) && !unicode.IsSpace(rune(c)):
-		// All other non-whitespace printables
-		// Regrettably, IsPrint accepts space chars
-		// Simply let chars accumulate within l.seq byte slice
-		return l.afterLeftSquareBracket
+// singleParam returns the main value of the lone parameter in params,
+// and whether exactly one (non-empty) parameter was present.
+func singleParam(params []Param) (int, bool) {
+	if len(params) != 1 || len(params[0]) == 0 || params[0][0] == MissingParam {
+		return 0, false
+	}
+	return params[0][0], true
+}
 
-	default: // discard weird char and reset to ground state
-		return l.ground
+// twoParams returns the main values of two semicolon-separated
+// parameters, and whether both were present and non-empty.
+func twoParams(params []Param) (a, b int, ok bool) {
+	if len(params) != 2 {
+		return 0, 0, false
+	}
+	pa, pb := params[0], params[1]
+	if len(pa) == 0 || pa[0] == MissingParam || len(pb) == 0 || pb[0] == MissingParam {
+		return 0, 0, false
 	}
+	return pa[0], pb[0], true
 }
 
-// interpret terminator Letter character
-func (l *Lexer) interpTerm(c byte) stateFn {
-	// analyze everything after the esc-[ sequence
-	body := string(l.seq[2:])
+// isHomeForm reports whether params represents the bare "H"/"f" form
+// (no parameters at all, or two explicitly empty ones, e.g. ";H").
+func isHomeForm(params []Param) bool {
+	if len(params) == 0 {
+		return true
+	}
+	if len(params) != 2 {
+		return false
+	}
+	pa, pb := params[0], params[1]
+	missing := func(p Param) bool { return len(p) == 0 || p[0] == MissingParam }
+	return missing(pa) && missing(pb)
+}
 
-	switch c {
+// decodeCSI translates a CSI dispatch's private marker, parameter
+// list, and final byte into one of the named TokVal constants (plus
+// its legacy []int parameters), where one exists.
+func decodeCSI(intermediates []byte, params []Param, final byte) (TokVal, []int) {
+	m := marker(intermediates)
+
+	switch final {
 	case 'h':
-		switch body {
-		case "20h":
-			l.send(SetNL)
-		case "?1h":
-			l.send(SetAppl)
-		case "?3h":
-			l.send(SetCol)
-		case "?4h":
-			l.send(SetSmooth)
-		case "?5h":
-			l.send(SetRevScrn)
-		case "?6h":
-			l.send(SetOrgRel)
-		case "?7h":
-			l.send(SetWrap)
-		case "?8h":
-			l.send(SetRep)
-		case "?9h":
-			l.send(SetInter)
+		v, ok := singleParam(params)
+		if m == '?' {
+			switch {
+			case ok && v == 1:
+				return SetAppl, nil
+			case ok && v == 3:
+				return SetCol, nil
+			case ok && v == 4:
+				return SetSmooth, nil
+			case ok && v == 5:
+				return SetRevScrn, nil
+			case ok && v == 6:
+				return SetOrgRel, nil
+			case ok && v == 7:
+				return SetWrap, nil
+			case ok && v == 8:
+				return SetRep, nil
+			case ok && v == 9:
+				return SetInter, nil
+			}
+		} else if ok && v == 20 {
+			return SetNL, nil
 		}
 
 	case 'l':
-		switch body {
-		case "20l":
-			l.send(SetLF)
-		case "?1l":
-			l.send(SetCursor)
-		case "?2l":
-			l.send(SetVT52)
-		case "?3l":
-			l.send(ResetCol)
-		case "?4l":
-			l.send(SetJump)
-		case "?5l":
-			l.send(SetNormScrn)
-		case "?6l":
-			l.send(SetOrgAbs)
-		case "?7l":
-			l.send(ResetWrap)
-		case "?8l":
-			l.send(ResetRep)
-		case "?9l":
-			l.send(ResetInter)
+		v, ok := singleParam(params)
+		if m == '?' {
+			switch {
+			case ok && v == 1:
+				return SetCursor, nil
+			case ok && v == 2:
+				return SetVT52, nil
+			case ok && v == 3:
+				return ResetCol, nil
+			case ok && v == 4:
+				return SetJump, nil
+			case ok && v == 5:
+				return SetNormScrn, nil
+			case ok && v == 6:
+				return SetOrgAbs, nil
+			case ok && v == 7:
+				return ResetWrap, nil
+			case ok && v == 8:
+				return ResetRep, nil
+			case ok && v == 9:
+				return ResetInter, nil
+			}
+		} else if ok && v == 20 {
+			return SetLF, nil
 		}
 
 	case 'm':
-		switch body {
-		case "m":
-			l.send(ModesOff)
-		case "0m":
-			l.send(ModesOff)
-		case "1m":
-			l.send(Bold)
-		case "2m":
-			l.send(LowInt)
-		case "4m":
-			l.send(Underline)
-		case "5m":
-			l.send(Blink)
-		case "7m":
-			l.send(Reverse)
-		case "8m":
-			l.send(Invisible)
+		if v, ok := singleParam(params); len(params) <= 1 {
+			switch {
+			case !ok || v == 0:
+				return ModesOff, nil
+			case v == 1:
+				return Bold, nil
+			case v == 2:
+				return LowInt, nil
+			case v == 4:
+				return Underline, nil
+			case v == 5:
+				return Blink, nil
+			case v == 7:
+				return Reverse, nil
+			case v == 8:
+				return Invisible, nil
+			}
 		}
+		// Anything not covered by the fixed one-parameter forms above
+		// -- multi-attribute strings, colors, strikethrough/overline,
+		// etc. -- is decoded by the full SGR subsystem instead.
+		return SGR, nil
 
 	case 'r':
-		var top, bottom byte
-		n, err := fmt.Sscanf(body, "%d;%d", &top, &bottom)
-		if (err == nil) && (n == 2) { // success case
-			l.params = []int{int(top), int(bottom)}
-			l.send(SetWin)
+		if top, bottom, ok := twoParams(params); ok {
+			return SetWin, []int{top, bottom}
 		}
 
 	case 'A':
-		var lines byte
-		n, err := fmt.Sscanf(body, "%d", &lines)
-		if (err == nil) && (n == 1) { // success case
-			l.params = []int{int(lines)}
-			l.send(CursorUp)
+		if v, ok := singleParam(params); ok {
+			return CursorUp, []int{v}
 		}
 
 	case 'B':
-		var lines byte
-		n, err := fmt.Sscanf(body, "%d", &lines)
-		if (err == nil) && (n == 1) { // success case
-			l.params = []int{int(lines)}
-			l.send(CursorDn)
+		if v, ok := singleParam(params); ok {
+			return CursorDn, []int{v}
 		}
 
 	case 'C':
-		var cols byte
-		n, err := fmt.Sscanf(body, "%d", &cols)
-		if (err == nil) && (n == 1) { // success case
-			l.params = []int{int(cols)}
-			l.send(CursorRt)
+		if v, ok := singleParam(params); ok {
+			return CursorRt, []int{v}
 		}
 
 	case 'D':
-		var cols byte
-		n, err := fmt.Sscanf(body, "%d", &cols)
-		if (err == nil) && (n == 1) { // success case
-			l.params = []int{int(cols)}
-			l.send(CursorLf)
+		if v, ok := singleParam(params); ok {
+			return CursorLf, []int{v}
 		}
 
 	case 'H':
-		if (body == "H") || (body == ";H") {
-			l.send(CursorHome)
-		} else {
-			var v, h byte
-			n, err := fmt.Sscanf(body, "%d;%d", &v, &h)
-			if (err == nil) && (n == 2) {
-				l.params = []int{int(v), int(h)}
-				l.send(CursorPos)
-			}
+		if isHomeForm(params) {
+			return CursorHome, nil
+		}
+		if v, h, ok := twoParams(params); ok {
+			return CursorPos, []int{v, h}
 		}
 
 	case 'f':
-		if (body == "f") || (body == ";f") {
-			l.send(HvHome)
-		} else {
-			var v, h byte
-			n, err := fmt.Sscanf(body, "%d;%d", &v, &h)
-			if (err == nil) && (n == 2) {
-				l.params = []int{int(v), int(h)}
-				l.send(HvPos)
-			}
+		if isHomeForm(params) {
+			return HvHome, nil
+		}
+		if v, h, ok := twoParams(params); ok {
+			return HvPos, []int{v, h}
 		}
 
 	case 'g':
-		switch body {
-		case "g":
-			l.send(TabClr)
-
-		case "0g":
-			l.send(TabClr)
-
-		case "3g":
-			l.send(TabClrAll)
+		v, ok := singleParam(params)
+		switch {
+		case !ok || v == 0:
+			return TabClr, nil
+		case v == 3:
+			return TabClrAll, nil
 		}
 
 	case 'K':
-		switch body {
-		case "K":
-			l.send(ClearEOL)
-
-		case "0K":
-			l.send(ClearEOL)
-
-		case "1K":
-			l.send(ClearBOL)
-
-		case "2K":
-			l.send(ClearLine)
+		v, ok := singleParam(params)
+		switch {
+		case !ok || v == 0:
+			return ClearEOL, nil
+		case v == 1:
+			return ClearBOL, nil
+		case v == 2:
+			return ClearLine, nil
 		}
 
 	case 'J':
-		switch body {
-		case "J":
-			l.send(ClearEOS)
-
-		case "0J":
-			l.send(ClearEOS)
-
-		case "1J":
-			l.send(ClearBOS)
-
-		case "2J":
-			l.send(ClearScreen)
+		v, ok := singleParam(params)
+		switch {
+		case !ok || v == 0:
+			return ClearEOS, nil
+		case v == 1:
+			return ClearBOS, nil
+		case v == 2:
+			return ClearScreen, nil
 		}
 
 	case 'c':
-		switch body {
-		case "c":
-			l.send(Ident)
-
-		case "0c":
-			l.send(Ident)
+		if v, ok := singleParam(params); !ok || v == 0 {
+			return Ident, nil
 		}
 
 	case 'y':
-		switch body {
-		case "2;1y":
-			l.send(TestPU)
+		if a, b, ok := twoParams(params); ok && a == 2 {
+			switch b {
+			case 1:
+				return TestPU, nil
+			case 2:
+				return TestLB, nil
+			case 9:
+				return TestPURep, nil
+			case 10:
+				return TestLBRep, nil
+			}
+		}
 
-		case "2;2y":
-			l.send(TestLB)
+	case 'q':
+		v, ok := singleParam(params)
+		switch {
+		case ok && v == 0:
+			return LedsOff, nil
+		case ok && v == 1:
+			return Led1, nil
+		case ok && v == 2:
+			return Led2, nil
+		case ok && v == 3:
+			return Led3, nil
+		case ok && v == 4:
+			return Led4, nil
+		}
+	}
 
-		case "2;9y":
-			l.send(TestPURep)
+	return Unknown, nil
+}
 
-		case "2;10y":
-			l.send(TestLBRep)
-		}
+// SGRAttr is a bitmask of the boolean SGR (Select Graphic Rendition)
+// attributes.
+type SGRAttr uint16
 
-	case 'q':
-		switch body {
-		case "0q":
-			l.send(LedsOff)
+// Boolean SGR attributes, set by SGR codes 1-5, 7-9 and 53, cleared by
+// their counterparts 21-25, 27-29 and 55. SGR 6 and 26 are not decoded.
+const (
+	AttrBold SGRAttr = 1 << iota
+	AttrDim
+	AttrItalic
+	AttrUnderline
+	AttrBlink
+	AttrReverse
+	AttrInvisible
+	AttrStrikethrough
+	AttrOverline
+)
 
-		case "1q":
-			l.send(Led1)
+// ColorKind identifies how an SGRColor's fields should be interpreted.
+type ColorKind int
 
-		case "2q":
-			l.send(Led2)
+const (
+	ColorDefault    ColorKind = iota // SGR 39/49: restore the default color
+	ColorIndexed                     // one of the 16 standard/bright colors (SGR 30-37/90-97, 40-47/100-107)
+	ColorPalette256                  // SGR 38:5:n / 48:5:n, n in 0-255
+	ColorRGB                         // SGR 38:2:r:g:b / 48:2:r:g:b truecolor
+)
 
-		case "3q":
-			l.send(Led3)
+// SGRColor is a decoded foreground or background color.
+type SGRColor struct {
+	Kind    ColorKind
+	Index   int   // for ColorIndexed (0-15) and ColorPalette256 (0-255)
+	R, G, B uint8 // for ColorRGB
+}
 
-		case "4q":
-			l.send(Led4)
-		}
-	}
+// SGRState is the decoded form of an SGR ('m') parameter list: every
+// attribute it sets, every attribute it clears, and any foreground or
+// background color it selects.
+type SGRState struct {
+	Reset      bool // SGR 0 (or no parameters at all): clear every attribute and color
+	Set        SGRAttr
+	Clear      SGRAttr
+	Foreground *SGRColor
+	Background *SGRColor
+}
 
-	return l.ground
+// mainValue returns p's leading value, treating both a totally empty
+// parameter and an explicitly missing one as the SGR default of 0.
+func mainValue(p Param) int {
+	if len(p) == 0 || p[0] == MissingParam {
+		return 0
+	}
+	return p[0]
 }
 
-func (l *Lexer) escPound(c byte) stateFn {
-	switch c {
-	case '3':
-		l.send(DhTop)
-	case '4':
-		l.send(DhBot)
-	case '5':
-		l.send(Swsh)
-	case '6':
-		l.send(Dwsh)
-	case '8':
-		l.send(Align)
+// paramAt returns p[i], or 0 if i is out of range or that sub-parameter
+// was left empty.
+func paramAt(p Param, i int) int {
+	if i < 0 || i >= len(p) || p[i] == MissingParam {
+		return 0
 	}
-	return l.ground
+	return p[i]
 }
 
-func (l *Lexer) afterLeftParen(c byte) stateFn {
-	switch c {
-	case 'A':
-		l.send(SetUKG0)
-	case 'B':
-		l.send(SetUSG0)
-	case '0':
-		l.send(SetSpecG0)
-	case '1':
-		l.send(SetAltG0)
-	case '2':
-		l.send(SetAltSpecG0)
+// decodeSGR decodes a full SGR parameter list -- semicolon-separated,
+// each possibly carrying colon sub-parameters -- into an SGRState.
+func decodeSGR(params []Param) SGRState {
+	var st SGRState
+	if len(params) == 0 {
+		st.Reset = true
+		return st
 	}
-	return l.ground
+
+	for i := 0; i < len(params); i++ {
+		p := params[i]
+		switch v := mainValue(p); {
+		case v == 0 && len(p) == 1:
+			st = SGRState{Reset: true}
+		case v == 1:
+			st.Set |= AttrBold
+		case v == 2:
+			st.Set |= AttrDim
+		case v == 3:
+			st.Set |= AttrItalic
+		case v == 4:
+			st.Set |= AttrUnderline
+		case v == 5:
+			st.Set |= AttrBlink
+		case v == 7:
+			st.Set |= AttrReverse
+		case v == 8:
+			st.Set |= AttrInvisible
+		case v == 9:
+			st.Set |= AttrStrikethrough
+		case v == 21:
+			st.Clear |= AttrBold
+		case v == 22:
+			st.Clear |= AttrBold | AttrDim
+		case v == 23:
+			st.Clear |= AttrItalic
+		case v == 24:
+			st.Clear |= AttrUnderline
+		case v == 25:
+			st.Clear |= AttrBlink
+		case v == 27:
+			st.Clear |= AttrReverse
+		case v == 28:
+			st.Clear |= AttrInvisible
+		case v == 29:
+			st.Clear |= AttrStrikethrough
+		case v == 53:
+			st.Set |= AttrOverline
+		case v == 55:
+			st.Clear |= AttrOverline
+		case v >= 30 && v <= 37:
+			st.Foreground = &SGRColor{Kind: ColorIndexed, Index: v - 30}
+		case v == 38:
+			color, consumed := parseSGRColor(p, params[i+1:])
+			st.Foreground = color
+			i += consumed
+		case v == 39:
+			st.Foreground = &SGRColor{Kind: ColorDefault}
+		case v >= 40 && v <= 47:
+			st.Background = &SGRColor{Kind: ColorIndexed, Index: v - 40}
+		case v == 48:
+			color, consumed := parseSGRColor(p, params[i+1:])
+			st.Background = color
+			i += consumed
+		case v == 49:
+			st.Background = &SGRColor{Kind: ColorDefault}
+		case v >= 90 && v <= 97:
+			st.Foreground = &SGRColor{Kind: ColorIndexed, Index: v - 90 + 8}
+		case v >= 100 && v <= 107:
+			st.Background = &SGRColor{Kind: ColorIndexed, Index: v - 100 + 8}
+		}
+	}
+	return st
 }
 
-func (l *Lexer) afterRightParen(c byte) stateFn {
-	switch c {
-	case 'A':
-		l.send(SetUKG1)
-	case 'B':
-		l.send(SetUSG1)
-	case '0':
-		l.send(SetSpecG1)
-	case '1':
-		l.send(SetAltG1)
-	case '2':
-		l.send(SetAltSpecG1)
+// parseSGRColor decodes the color introduced by an SGR 38 or 48
+// parameter. p is that parameter itself, which already carries the
+// whole spec if written in colon form (38:5:n, 38:2::r:g:b); rest is
+// the remaining top-level parameters, consulted for the more common
+// semicolon form (38;5;n, 38;2;r;g;b), in which case the number of
+// extra top-level parameters consumed is returned.
+func parseSGRColor(p Param, rest []Param) (*SGRColor, int) {
+	if len(p) > 1 {
+		switch paramAt(p, 1) {
+		case 5:
+			return &SGRColor{Kind: ColorPalette256, Index: paramAt(p, 2)}, 0
+		case 2:
+			// p is [38, 2, (optional colorspace id), r, g, b].
+			n := len(p)
+			if n < 5 {
+				return nil, 0
+			}
+			return &SGRColor{
+				Kind: ColorRGB,
+				R:    uint8(paramAt(p, n-3)),
+				G:    uint8(paramAt(p, n-2)),
+				B:    uint8(paramAt(p, n-1)),
+			}, 0
+		}
+		return nil, 0
+	}
+
+	if len(rest) == 0 {
+		return nil, 0
 	}
-	return l.ground
+	switch mainValue(rest[0]) {
+	case 5:
+		if len(rest) < 2 {
+			return nil, len(rest)
+		}
+		return &SGRColor{Kind: ColorPalette256, Index: mainValue(rest[1])}, 2
+	case 2:
+		if len(rest) < 4 {
+			return nil, len(rest)
+		}
+		return &SGRColor{
+			Kind: ColorRGB,
+			R:    uint8(mainValue(rest[1])),
+			G:    uint8(mainValue(rest[2])),
+			B:    uint8(mainValue(rest[3])),
+		}, 4
+	}
+	return nil, 0
 }
 
-func (l *Lexer) escapeDigit(c byte) stateFn {
-	body := string(l.seq[1:])
-	switch body {
-	case "5n":
-		l.send(DevStat)
+// TitleState is the decoded form of an OSC 0, 1, or 2 sequence
+// (Value == SetTitle): OSC 0 sets both the icon name and the window
+// title, OSC 1 just the icon name, and OSC 2 just the window title.
+type TitleState struct {
+	Icon   bool // the icon name should be set to Text
+	Window bool // the window title should be set to Text
+	Text   string
+}
+
+// HyperlinkState is the decoded form of an OSC 8 sequence (Value ==
+// Hyperlink), per the de facto terminal hyperlink convention. An empty
+// URI closes the most recently opened hyperlink.
+type HyperlinkState struct {
+	Params map[string]string // e.g. {"id": "abc123"}
+	URI    string
+}
+
+// decodeOSC recognizes the well-known OSC payloads -- 0/1/2 (icon and
+// window title) and 8 (hyperlinks) -- decorating tok with their
+// structured form. Anything else is left as Value == Unknown, with the
+// raw payload still available via tok.Text.
+func decodeOSC(payload string, tok *Token) {
+	ps, rest, _ := strings.Cut(payload, ";")
+	n, err := strconv.Atoi(ps)
+	if err != nil {
+		return
+	}
 
-	case "6n":
-		l.send(GetCursor)
+	switch n {
+	case 0, 1, 2:
+		tok.Value = SetTitle
+		tok.Title = &TitleState{
+			Icon:   n == 0 || n == 1,
+			Window: n == 0 || n == 2,
+			Text:   rest,
+		}
+
+	case 8:
+		params, uri, _ := strings.Cut(rest, ";")
+		tok.Value = Hyperlink
+		tok.Link = &HyperlinkState{
+			Params: parseOSCParams(params),
+			URI:    uri,
+		}
+	}
+}
+
+// parseOSCParams decodes the colon-separated "key=value" params that
+// precede the URI in an OSC 8 payload, e.g. "id=abc123".
+func parseOSCParams(s string) map[string]string {
+	if s == "" {
+		return nil
+	}
+	params := make(map[string]string)
+	for _, kv := range strings.Split(s, ":") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			params[k] = v
+		}
 	}
-	return l.ground
+	return params
 }
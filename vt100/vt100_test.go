@@ -1,8 +1,9 @@
 package vt100
 
 import (
+	"bytes"
 	"errors"
-	//	"fmt"
+	"fmt"
 	"math/rand"
 	"testing"
 	"time"
@@ -182,3 +183,420 @@ func TestVT(t *testing.T) {
 done:
 	vtlx.Rundown()
 }
+
+// TestWriter exercises the synchronous io.Writer front end, checking
+// that it recognizes the same sequences as the channel-based API and
+// that the raw bytes are recoverable via Token.Bytes.
+func TestWriter(t *testing.T) {
+	var got []*Token
+	lx := NewWriter(func(tok *Token) { got = append(got, tok) })
+
+	seq := "A\033[H\033[1m"
+	if _, err := lx.Write([]byte(seq)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	want := []TokVal{'A', CursorHome, Bold}
+	if len(got) != len(want) {
+		t.Fatalf("got %d tokens, want %d: %v", len(got), len(want), got)
+	}
+	for i, w := range want {
+		if got[i].Value != w {
+			t.Errorf("token %d: got %s, want %s", i, got[i].Value, w)
+		}
+	}
+
+	if bs := got[1].Bytes(); string(bs) != "\033[H" {
+		t.Errorf("Bytes() = %#v, want %#v", string(bs), "\033[H")
+	}
+}
+
+// realisticTraffic is a chunk of representative terminal output: plain
+// text interspersed with cursor movement and SGR attribute changes.
+const realisticTraffic = "\033[1;31mHello, world!\033[0m\r\n" +
+	"\033[2J\033[H\033[4mstatus\033[24m: running\r\n" +
+	"\033[10;20Hsome more plain text to lex\033[K\r\n"
+
+// BenchmarkWriter measures the synchronous io.Writer front end, which
+// runs the state machine directly in the caller's goroutine.
+func BenchmarkWriter(b *testing.B) {
+	lx := NewWriter(func(*Token) {})
+	buf := []byte(realisticTraffic)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lx.Write(buf)
+	}
+}
+
+// BenchmarkChannel measures the legacy channel-based API for
+// comparison; every byte crosses a channel and is lexed on a separate
+// goroutine.
+func BenchmarkChannel(b *testing.B) {
+	lx := NewLexer()
+	defer lx.Rundown()
+	buf := []byte(realisticTraffic)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, c := range buf {
+			lx.SendChar(c)
+			select {
+			case <-lx.Output:
+			default:
+			}
+		}
+	}
+}
+
+// writeOne feeds seq through a fresh Lexer and returns the single
+// token it expects to come out.
+func writeOne(t *testing.T, seq string) *Token {
+	t.Helper()
+	var got []*Token
+	lx := NewWriter(func(tok *Token) { got = append(got, tok) })
+	lx.Write([]byte(seq))
+	if len(got) != 1 {
+		t.Fatalf("seq=%#v: got %d tokens, want 1: %v", seq, len(got), got)
+	}
+	return got[0]
+}
+
+// TestCSIParams checks that semicolon- and colon-separated parameters,
+// including missing/empty sub-parameters, are parsed into RawParams.
+func TestCSIParams(t *testing.T) {
+	cases := []struct {
+		seq  string
+		want []Param
+	}{
+		{"\033[13;17H", []Param{{13}, {17}}},
+		{"\033[;H", []Param{{MissingParam}, {MissingParam}}},
+		{"\033[1;31;48:2::10:20:30m", []Param{{1}, {31}, {48, 2, MissingParam, 10, 20, 30}}},
+		{"\033[38:5:220m", []Param{{38, 5, 220}}},
+	}
+
+	for _, c := range cases {
+		tok := writeOne(t, c.seq)
+		if len(tok.RawParams) != len(c.want) {
+			t.Errorf("seq=%#v: RawParams=%v, want %v", c.seq, tok.RawParams, c.want)
+			continue
+		}
+		for i, g := range c.want {
+			if fmt.Sprint([]int(tok.RawParams[i])) != fmt.Sprint([]int(g)) {
+				t.Errorf("seq=%#v: RawParams[%d]=%v, want %v", c.seq, i, tok.RawParams[i], g)
+			}
+		}
+	}
+}
+
+// TestCSIUnknown checks that a CSI dispatch with no legacy TokVal
+// mapping still reports its raw dispatch details instead of being
+// dropped.
+func TestCSIUnknown(t *testing.T) {
+	tok := writeOne(t, "\033[99z")
+	if tok.Kind != KindCSI {
+		t.Fatalf("Kind = %v, want KindCSI", tok.Kind)
+	}
+	if tok.Value != Unknown {
+		t.Errorf("Value = %s, want Unknown", tok.Value)
+	}
+	if tok.Final != 'z' {
+		t.Errorf("Final = %q, want 'z'", tok.Final)
+	}
+}
+
+// TestSGR checks decoding of multi-attribute SGR strings and the
+// colon- and semicolon-forms of 256-color and truecolor escapes,
+// including the "missing subparam" cases that show up as empty
+// fields in colon-separated sub-parameter groups.
+func TestSGR(t *testing.T) {
+	cases := []struct {
+		seq  string
+		want SGRState
+	}{
+		{
+			"\033[1;4;31m",
+			SGRState{
+				Set:        AttrBold | AttrUnderline,
+				Foreground: &SGRColor{Kind: ColorIndexed, Index: 1},
+			},
+		},
+		{
+			"\033[38;5;220m",
+			SGRState{Foreground: &SGRColor{Kind: ColorPalette256, Index: 220}},
+		},
+		{
+			"\033[38:5:220m",
+			SGRState{Foreground: &SGRColor{Kind: ColorPalette256, Index: 220}},
+		},
+		{
+			"\033[38;2;10;20;30m",
+			SGRState{Foreground: &SGRColor{Kind: ColorRGB, R: 10, G: 20, B: 30}},
+		},
+		{
+			// Colon form without the optional colorspace-id field.
+			"\033[38:2:10:20:30m",
+			SGRState{Foreground: &SGRColor{Kind: ColorRGB, R: 10, G: 20, B: 30}},
+		},
+		{
+			// Colon form with an empty (missing) colorspace-id field.
+			"\033[38:2::10:20:30m",
+			SGRState{Foreground: &SGRColor{Kind: ColorRGB, R: 10, G: 20, B: 30}},
+		},
+		{
+			// Missing subparam: an empty field in the middle of the
+			// colon group is treated as 0, not as ending the group.
+			"\033[48:2::255::0m",
+			SGRState{Background: &SGRColor{Kind: ColorRGB, R: 255, G: 0, B: 0}},
+		},
+		{
+			"\033[1;0m",
+			SGRState{Reset: true},
+		},
+	}
+
+	for _, c := range cases {
+		tok := writeOne(t, c.seq)
+		if tok.Value != SGR {
+			t.Fatalf("seq=%#v: Value = %s, want SGR", c.seq, tok.Value)
+		}
+		if tok.SGR == nil {
+			t.Fatalf("seq=%#v: SGR = nil", c.seq)
+		}
+		if !sameSGR(*tok.SGR, c.want) {
+			t.Errorf("seq=%#v: SGR = %s, want %s", c.seq, sgrString(*tok.SGR), sgrString(c.want))
+		}
+	}
+}
+
+// sameSGR compares two SGRStates by value, dereferencing Foreground
+// and Background rather than comparing pointers.
+func sameSGR(a, b SGRState) bool {
+	if a.Reset != b.Reset || a.Set != b.Set || a.Clear != b.Clear {
+		return false
+	}
+	return sameSGRColor(a.Foreground, b.Foreground) && sameSGRColor(a.Background, b.Background)
+}
+
+func sameSGRColor(a, b *SGRColor) bool {
+	if (a == nil) != (b == nil) {
+		return false
+	}
+	if a == nil {
+		return true
+	}
+	return *a == *b
+}
+
+func sgrString(s SGRState) string {
+	fg, bg := "nil", "nil"
+	if s.Foreground != nil {
+		fg = fmt.Sprint(*s.Foreground)
+	}
+	if s.Background != nil {
+		bg = fmt.Sprint(*s.Background)
+	}
+	return fmt.Sprintf("{Reset:%v Set:%v Clear:%v Foreground:%s Background:%s}", s.Reset, s.Set, s.Clear, fg, bg)
+}
+
+// TestText checks that ground-state input is decoded as native UTF-8,
+// one rune per token, rather than masked or split byte-by-byte.
+func TestText(t *testing.T) {
+	cases := []rune{'A', '~', 'é', '€', '世', '🎉'}
+	for _, want := range cases {
+		tok := writeOne(t, string(want))
+		if tok.Kind != KindText {
+			t.Fatalf("rune=%q: Kind = %v, want KindText", want, tok.Kind)
+		}
+		if tok.Text != string(want) {
+			t.Errorf("rune=%q: Text = %#v, want %#v", want, tok.Text, string(want))
+		}
+	}
+
+	// A lone, invalid continuation byte still decodes to something (the
+	// Unicode replacement character) rather than hanging or panicking.
+	tok := writeOne(t, "\x80")
+	if tok.Kind != KindText {
+		t.Fatalf("Kind = %v, want KindText", tok.Kind)
+	}
+	if tok.Text != "�" {
+		t.Errorf("Text = %#v, want %#v", tok.Text, "�")
+	}
+}
+
+// writeAllText writes p in one shot and concatenates every resulting
+// KindText token's Text, in order, reconstructing what the stream
+// decoded to as a whole rather than checking one token at a time.
+func writeAllText(p []byte) string {
+	var out []byte
+	lx := NewWriter(func(tok *Token) {
+		if tok.Kind == KindText {
+			out = append(out, tok.Text...)
+		}
+	})
+	lx.Write(p)
+	return string(out)
+}
+
+// TestTextResync checks that a malformed (non-UTF-8) byte in ground
+// state is replaced in place, without dropping or shifting any of the
+// plain ASCII bytes around it -- a truncated lead byte or a stray
+// continuation byte must not desync the decoder for the rest of the
+// stream.
+func TestTextResync(t *testing.T) {
+	cases := []struct {
+		in   []byte
+		want string
+	}{
+		// Truncated 3-byte lead (0xE2 expects two continuation bytes)
+		// immediately followed by plain ASCII.
+		{[]byte{0xE2, 'A', 'B', 'C', 'D'}, "�ABCD"},
+		// Latin-1 "café" mixed with ASCII: the 0xE9 ('é' in Latin-1) is
+		// not valid UTF-8 on its own.
+		{[]byte("caf\xe9 and more text"), "caf� and more text"},
+		// A stray continuation byte with no lead byte at all.
+		{[]byte{'X', 0x80, 'Y'}, "X�Y"},
+		// A control byte (newline) interrupting a truncated lead byte.
+		{[]byte{0xE2, '\n'}, "�"},
+	}
+
+	for _, c := range cases {
+		got := writeAllText(c.in)
+		if got != c.want {
+			t.Errorf("in=%#v: reconstructed = %#v, want %#v", string(c.in), got, c.want)
+		}
+	}
+}
+
+// TestOSC checks that an OSC string is accumulated and delivered as a
+// single token, terminated by either ST or BEL, and that the well-known
+// OSC 0/1/2 (title) and OSC 8 (hyperlink) forms are decoded.
+func TestOSC(t *testing.T) {
+	for _, seq := range []string{
+		"\033]0;my title\007",
+		"\033]0;my title\033\\",
+	} {
+		tok := writeOne(t, seq)
+		if tok.Kind != KindOSC {
+			t.Fatalf("seq=%#v: Kind = %v, want KindOSC", seq, tok.Kind)
+		}
+		if tok.Text != "0;my title" {
+			t.Errorf("seq=%#v: Text = %#v, want %#v", seq, tok.Text, "0;my title")
+		}
+		if tok.Value != SetTitle {
+			t.Errorf("seq=%#v: Value = %s, want SetTitle", seq, tok.Value)
+		}
+		if tok.Title == nil || !tok.Title.Icon || !tok.Title.Window || tok.Title.Text != "my title" {
+			t.Errorf("seq=%#v: Title = %+v, want {Icon:true Window:true Text:\"my title\"}", seq, tok.Title)
+		}
+	}
+
+	tok := writeOne(t, "\033]1;icon only\007")
+	if tok.Title == nil || !tok.Title.Icon || tok.Title.Window {
+		t.Errorf("OSC 1: Title = %+v, want Icon-only", tok.Title)
+	}
+
+	tok = writeOne(t, "\033]2;window only\007")
+	if tok.Title == nil || tok.Title.Icon || !tok.Title.Window {
+		t.Errorf("OSC 2: Title = %+v, want Window-only", tok.Title)
+	}
+
+	tok = writeOne(t, "\033]8;id=abc123;https://example.com\033\\")
+	if tok.Value != Hyperlink {
+		t.Fatalf("OSC 8: Value = %s, want Hyperlink", tok.Value)
+	}
+	if tok.Link == nil || tok.Link.URI != "https://example.com" || tok.Link.Params["id"] != "abc123" {
+		t.Errorf("OSC 8: Link = %+v, want URI=https://example.com, Params[id]=abc123", tok.Link)
+	}
+
+	tok = writeOne(t, "\033]8;;\033\\")
+	if tok.Value != Hyperlink {
+		t.Fatalf("OSC 8 close: Value = %s, want Hyperlink", tok.Value)
+	}
+	if tok.Link == nil || tok.Link.URI != "" || len(tok.Link.Params) != 0 {
+		t.Errorf("OSC 8 close: Link = %+v, want empty URI and no params", tok.Link)
+	}
+}
+
+// TestDCS checks that a DCS sequence's parameters and passthrough data
+// are both captured on the resulting token.
+func TestDCS(t *testing.T) {
+	tok := writeOne(t, "\033P1$rpassthrough data\033\\")
+	if tok.Kind != KindDCS {
+		t.Fatalf("Kind = %v, want KindDCS", tok.Kind)
+	}
+	if tok.Final != 'r' {
+		t.Errorf("Final = %q, want 'r'", tok.Final)
+	}
+	if tok.Text != "passthrough data" {
+		t.Errorf("Text = %#v, want %#v", tok.Text, "passthrough data")
+	}
+	if len(tok.RawParams) != 1 || len(tok.RawParams[0]) != 1 || tok.RawParams[0][0] != 1 {
+		t.Errorf("RawParams = %v, want [[1]]", tok.RawParams)
+	}
+}
+
+// TestStringCap checks that an OSC payload or DCS passthrough body is
+// capped at maxStringLen rather than growing without bound when fed by
+// a peer that never sends a terminator.
+func TestStringCap(t *testing.T) {
+	huge := bytes.Repeat([]byte("x"), maxStringLen*2)
+
+	oscTok := writeOne(t, "\033]0;"+string(huge)+"\007")
+	if len(oscTok.Text) != maxStringLen {
+		t.Errorf("OSC Text length = %d, want %d", len(oscTok.Text), maxStringLen)
+	}
+
+	dcsTok := writeOne(t, "\033P1$r"+string(huge)+"\033\\")
+	if len(dcsTok.Text) != maxStringLen {
+		t.Errorf("DCS Text length = %d, want %d", len(dcsTok.Text), maxStringLen)
+	}
+
+	// Bytes() must be capped right along with Text -- it's backed by the
+	// same unterminated accumulation, just via a different field.
+	if n := len(oscTok.Bytes()); n > maxStringLen+16 {
+		t.Errorf("OSC Bytes() length = %d, want roughly <= %d", n, maxStringLen)
+	}
+}
+
+// TestStringEscapeResync checks that an ESC inside an OSC/DCS/SOS-PM-APC
+// string that turns out not to be a valid ST (i.e. not followed by
+// '\') doesn't leak the aborted string's raw bytes into the next
+// token's Bytes().
+func TestStringEscapeResync(t *testing.T) {
+	tok := writeOne(t, "\033]0;some long title here\033[H")
+	if tok.Kind != KindCSI || tok.Value != CursorHome {
+		t.Fatalf("Kind/Value = %v/%s, want KindCSI/CursorHome", tok.Kind, tok.Value)
+	}
+	if got := string(tok.Bytes()); got != "\033[H" {
+		t.Errorf("Bytes() = %#v, want %#v", got, "\033[H")
+	}
+}
+
+// FuzzWrite throws corrupt and boundary-case input straight at the
+// state machine and checks only that it never panics or hangs; any
+// input, valid or not, must leave the lexer in a sane state.
+func FuzzWrite(f *testing.F) {
+	seeds := []string{
+		"",
+		"A",
+		"\033",
+		"\033[",
+		"\033[H",
+		"\033[1;31;48:2::10:20:30m",
+		"\033]0;title\007",
+		"\033]8;;https://example.com\033\\text\033]8;;\033\\",
+		"\033P1$rdata\033\\",
+		"\033X discarded \033\\",
+		"\x18\x1a\x9b\x9c\x9d\x90",
+		realisticTraffic,
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		lx := NewWriter(func(*Token) {})
+		lx.Write([]byte(s))
+	})
+}